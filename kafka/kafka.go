@@ -2,18 +2,37 @@ package kafka
 
 import (
 	"context"
+	"crypto/tls"
+	"regexp"
 	"time"
 
-	"github.com/Shopify/sarama"
-	"github.com/bsm/sarama-cluster"
+	"github.com/IBM/sarama"
 	"github.com/uw-labs/substrate"
 )
 
 var (
 	_ substrate.AsyncMessageSink   = (*AsyncMessageSink)(nil)
+	_ substrate.AsyncMessageSink   = (*TransactionalAsyncMessageSink)(nil)
 	_ substrate.AsyncMessageSource = (*AsyncMessageSource)(nil)
+	_ substrate.AsyncMessageSource = (*PartitionedAsyncMessageSource)(nil)
+	_ KafkaMessage                 = (*consumerMessage)(nil)
 )
 
+// KafkaMessage is implemented by messages consumed from a Kafka source, and
+// exposes the Kafka-specific metadata that substrate.Message alone doesn't
+// carry. AsyncMessageSink recognises messages implementing it (or just its
+// Key()/Headers()/Timestamp() methods) and repopulates that metadata on the
+// outgoing sarama.ProducerMessage.
+type KafkaMessage interface {
+	substrate.Message
+	Key() []byte
+	Headers() []sarama.RecordHeader
+	Timestamp() time.Time
+	Topic() string
+	Partition() int32
+	Offset() int64
+}
+
 const (
 	// OffsetOldest indicates the oldest appropriate message available on the broker.
 	OffsetOldest int64 = -2
@@ -23,14 +42,98 @@ const (
 	defaultMetadataRefreshFrequency = 10 * time.Minute
 )
 
+// SASLMechanism identifies the SASL authentication mechanism to use when
+// connecting to the broker.
+type SASLMechanism sarama.SASLMechanism
+
+const (
+	SASLMechanismPlain       = SASLMechanism(sarama.SASLTypePlaintext)
+	SASLMechanismSCRAMSHA256 = SASLMechanism(sarama.SASLTypeSCRAMSHA256)
+	SASLMechanismSCRAMSHA512 = SASLMechanism(sarama.SASLTypeSCRAMSHA512)
+)
+
+// SASLConfig holds the credentials and mechanism used to authenticate with
+// the broker over SASL.
+type SASLConfig struct {
+	Username  string
+	Password  string
+	Mechanism SASLMechanism
+}
+
+func (sc *SASLConfig) apply(conf *sarama.Config) {
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.User = sc.Username
+	conf.Net.SASL.Password = sc.Password
+	conf.Net.SASL.Mechanism = sarama.SASLMechanism(sc.Mechanism)
+}
+
 type AsyncMessageSinkConfig struct {
 	Brokers         []string
 	Topic           string
 	MaxMessageBytes int
 	KeyFunc         func(substrate.Message) []byte
 	Version         *sarama.KafkaVersion
+
+	// TLS, if set, enables TLS and is used to configure the connection to
+	// the broker.
+	TLS *tls.Config
+
+	// SASL, if set, enables SASL authentication with the broker.
+	SASL *SASLConfig
+
+	// Compression sets the compression codec used to compress messages
+	// before they're sent to the broker. Defaults to CompressionNone.
+	Compression Compression
+
+	// RequiredAcks sets the level of acknowledgement reliability needed
+	// from the broker. Defaults to RequiredAcksAll. A pointer so that
+	// RequiredAcksNone (which is the zero value) can be distinguished
+	// from "not configured".
+	RequiredAcks *RequiredAcks
+
+	// MaxRetries is the total number of times to retry sending a message
+	// before giving up. Defaults to 3.
+	MaxRetries int
+
+	// FlushFrequency is the best-effort frequency of flushes. Messages
+	// may be flushed sooner if FlushMessages or FlushBytes is reached.
+	FlushFrequency time.Duration
+
+	// FlushMessages is the number of messages needed to trigger a flush.
+	FlushMessages int
+
+	// FlushBytes is the number of bytes needed to trigger a flush.
+	FlushBytes int
+
+	// Idempotent enables Sarama's idempotent producer, which guarantees
+	// that retries can't introduce duplicate messages on a partition. It
+	// requires RequiredAcksAll and a single in-flight request per
+	// connection, both of which are set automatically.
+	Idempotent bool
 }
 
+// Compression identifies the compression codec used for producing
+// messages.
+type Compression sarama.CompressionCodec
+
+const (
+	CompressionNone   = Compression(sarama.CompressionNone)
+	CompressionGZIP   = Compression(sarama.CompressionGZIP)
+	CompressionSnappy = Compression(sarama.CompressionSnappy)
+	CompressionLZ4    = Compression(sarama.CompressionLZ4)
+	CompressionZSTD   = Compression(sarama.CompressionZSTD)
+)
+
+// RequiredAcks identifies the level of acknowledgement reliability needed
+// from the broker before a produced message is considered sent.
+type RequiredAcks sarama.RequiredAcks
+
+const (
+	RequiredAcksNone  = RequiredAcks(sarama.NoResponse)
+	RequiredAcksLocal = RequiredAcks(sarama.WaitForLocal)
+	RequiredAcksAll   = RequiredAcks(sarama.WaitForAll)
+)
+
 func NewAsyncMessageSink(config AsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
 
 	conf := config.buildSaramaProducerConfig()
@@ -90,8 +193,19 @@ func (ams *AsyncMessageSink) doPublishMessages(ctx context.Context, producer sar
 
 			message.Value = sarama.ByteEncoder(m.Data())
 
-			if ams.KeyFunc != nil {
+			switch {
+			case ams.KeyFunc != nil:
 				message.Key = sarama.ByteEncoder(ams.KeyFunc(m))
+			case messageKey(m) != nil:
+				message.Key = sarama.ByteEncoder(messageKey(m))
+			}
+
+			if h, ok := m.(interface{ Headers() []sarama.RecordHeader }); ok {
+				message.Headers = h.Headers()
+			}
+
+			if ts, ok := m.(interface{ Timestamp() time.Time }); ok {
+				message.Timestamp = ts.Timestamp()
 			}
 
 			message.Metadata = m
@@ -104,18 +218,57 @@ func (ams *AsyncMessageSink) doPublishMessages(ctx context.Context, producer sar
 	}
 }
 
+// messageKey returns the Kafka key carried by m, if it exposes one, or nil
+// otherwise.
+func messageKey(m substrate.Message) []byte {
+	if k, ok := m.(interface{ Key() []byte }); ok {
+		return k.Key()
+	}
+	return nil
+}
+
 func (ams *AsyncMessageSink) Status() (*substrate.Status, error) {
 	return status(ams.client, ams.Topic)
 }
 
 func (ams *AsyncMessageSinkConfig) buildSaramaProducerConfig() *sarama.Config {
 	conf := sarama.NewConfig()
-	conf.Producer.RequiredAcks = sarama.WaitForAll // make configurable
+	conf.Producer.RequiredAcks = sarama.RequiredAcks(RequiredAcksAll)
 	conf.Producer.Return.Successes = true
 	conf.Producer.Return.Errors = true
 	conf.Producer.Retry.Max = 3
 	conf.Producer.Timeout = time.Duration(60) * time.Second
 
+	if ams.RequiredAcks != nil {
+		conf.Producer.RequiredAcks = sarama.RequiredAcks(*ams.RequiredAcks)
+	}
+
+	if ams.Compression != 0 {
+		conf.Producer.Compression = sarama.CompressionCodec(ams.Compression)
+	}
+
+	if ams.MaxRetries != 0 {
+		conf.Producer.Retry.Max = ams.MaxRetries
+	}
+
+	if ams.FlushFrequency != 0 {
+		conf.Producer.Flush.Frequency = ams.FlushFrequency
+	}
+
+	if ams.FlushMessages != 0 {
+		conf.Producer.Flush.Messages = ams.FlushMessages
+	}
+
+	if ams.FlushBytes != 0 {
+		conf.Producer.Flush.Bytes = ams.FlushBytes
+	}
+
+	if ams.Idempotent {
+		conf.Producer.Idempotent = true
+		conf.Net.MaxOpenRequests = 1
+		conf.Producer.RequiredAcks = sarama.WaitForAll
+	}
+
 	if ams.MaxMessageBytes != 0 {
 		if ams.MaxMessageBytes > int(sarama.MaxRequestSize) {
 			sarama.MaxRequestSize = int32(ams.MaxMessageBytes)
@@ -132,6 +285,16 @@ func (ams *AsyncMessageSinkConfig) buildSaramaProducerConfig() *sarama.Config {
 	if ams.Version != nil {
 		conf.Version = *ams.Version
 	}
+
+	if ams.TLS != nil {
+		conf.Net.TLS.Enable = true
+		conf.Net.TLS.Config = ams.TLS
+	}
+
+	if ams.SASL != nil {
+		ams.SASL.apply(conf)
+	}
+
 	return conf
 }
 
@@ -141,19 +304,247 @@ func (ams *AsyncMessageSink) Close() error {
 	return ams.client.Close()
 }
 
+const (
+	defaultTransactionBatchSize    = 100
+	defaultTransactionBatchTimeout = time.Second
+)
+
+// TransactionalAsyncMessageSinkConfig configures a
+// TransactionalAsyncMessageSink.
+type TransactionalAsyncMessageSinkConfig struct {
+	AsyncMessageSinkConfig
+
+	// TransactionalID identifies the producer across restarts, and is
+	// required for transactional production.
+	TransactionalID string
+
+	// BatchSize is the maximum number of messages committed in a single
+	// Kafka transaction. Defaults to 100.
+	BatchSize int
+
+	// BatchTimeout is the maximum time to wait for BatchSize messages
+	// before committing a partial transaction. Defaults to 1s.
+	BatchTimeout time.Duration
+}
+
+func (c *TransactionalAsyncMessageSinkConfig) buildSaramaProducerConfig() *sarama.Config {
+	conf := c.AsyncMessageSinkConfig.buildSaramaProducerConfig()
+	conf.Producer.Idempotent = true
+	conf.Net.MaxOpenRequests = 1
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+	conf.Producer.Transaction.ID = c.TransactionalID
+	return conf
+}
+
+// NewTransactionalAsyncMessageSink creates a substrate.AsyncMessageSink
+// that publishes messages in batches, each committed as a single Kafka
+// transaction, for exactly-once-semantics pipelines.
+func NewTransactionalAsyncMessageSink(config TransactionalAsyncMessageSinkConfig) (substrate.AsyncMessageSink, error) {
+
+	conf := config.buildSaramaProducerConfig()
+	client, err := sarama.NewClient(config.Brokers, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize := defaultTransactionBatchSize
+	if config.BatchSize > 0 {
+		batchSize = config.BatchSize
+	}
+	batchTimeout := defaultTransactionBatchTimeout
+	if config.BatchTimeout > 0 {
+		batchTimeout = config.BatchTimeout
+	}
+
+	sink := TransactionalAsyncMessageSink{
+		client:       client,
+		Topic:        config.Topic,
+		KeyFunc:      config.KeyFunc,
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+	}
+	return &sink, nil
+}
+
+// TransactionalAsyncMessageSink is a kafka message sink that batches
+// published messages into Kafka transactions, and only acks a batch once
+// its transaction has committed.
+type TransactionalAsyncMessageSink struct {
+	client       sarama.Client
+	Topic        string
+	KeyFunc      func(substrate.Message) []byte
+	batchSize    int
+	batchTimeout time.Duration
+}
+
+// PublishMessages implements the PublishMessages method of the
+// substrate.AsyncMessageSink interface.
+func (ams *TransactionalAsyncMessageSink) PublishMessages(ctx context.Context, acks chan<- substrate.Message, messages <-chan substrate.Message) (rerr error) {
+
+	producer, err := sarama.NewAsyncProducerFromClient(ams.client)
+	if err != nil {
+		return err
+	}
+
+	err = ams.doPublishMessages(ctx, producer, acks, messages)
+	if err != nil {
+		_ = producer.Close()
+		return err
+	}
+	return producer.Close()
+}
+
+func (ams *TransactionalAsyncMessageSink) doPublishMessages(ctx context.Context, producer sarama.AsyncProducer, acks chan<- substrate.Message, messages <-chan substrate.Message) (rerr error) {
+
+	input := producer.Input()
+	errs := producer.Errors()
+	successes := producer.Successes()
+
+	go func() {
+		for range successes {
+		}
+	}()
+
+	for {
+		if err := producer.BeginTxn(); err != nil {
+			return err
+		}
+
+		batch, done, err := ams.produceBatch(ctx, input, errs, messages)
+		if err != nil {
+			_ = producer.AbortTxn()
+			return err
+		}
+
+		if len(batch) == 0 {
+			if err := producer.AbortTxn(); err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+			continue
+		}
+
+		if err := producer.CommitTxn(); err != nil {
+			_ = producer.AbortTxn()
+			return err
+		}
+
+		// The transaction is already committed, so these messages must
+		// be acked regardless of ctx — the caller needs to know they
+		// were persisted, or it risks re-publishing them as duplicates.
+		// Delivering them on their own goroutine, the same way the
+		// successes drain above decouples from the main loop, means a
+		// caller that has stopped reading acks (e.g. because it's
+		// shutting down) can't block this loop from observing ctx/errs
+		// and returning.
+		go func(batch []substrate.Message) {
+			for _, m := range batch {
+				acks <- m
+			}
+		}(batch)
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// produceBatch reads up to ams.batchSize messages from messages, producing
+// each within the already-open transaction, and returns the messages it
+// produced. It stops early, with done set, once messages is closed or ctx
+// is done; otherwise it stops once batchSize messages are collected or
+// batchTimeout elapses.
+func (ams *TransactionalAsyncMessageSink) produceBatch(ctx context.Context, input chan<- *sarama.ProducerMessage, errs <-chan *sarama.ProducerError, messages <-chan substrate.Message) (batch []substrate.Message, done bool, rerr error) {
+
+	timeout := time.NewTimer(ams.batchTimeout)
+	defer timeout.Stop()
+
+	for len(batch) < ams.batchSize {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return batch, true, nil
+			}
+
+			message := &sarama.ProducerMessage{
+				Topic: ams.Topic,
+				Value: sarama.ByteEncoder(m.Data()),
+			}
+
+			switch {
+			case ams.KeyFunc != nil:
+				message.Key = sarama.ByteEncoder(ams.KeyFunc(m))
+			case messageKey(m) != nil:
+				message.Key = sarama.ByteEncoder(messageKey(m))
+			}
+
+			if h, ok := m.(interface{ Headers() []sarama.RecordHeader }); ok {
+				message.Headers = h.Headers()
+			}
+
+			if ts, ok := m.(interface{ Timestamp() time.Time }); ok {
+				message.Timestamp = ts.Timestamp()
+			}
+
+			input <- message
+			batch = append(batch, m)
+		case err := <-errs:
+			return batch, false, err
+		case <-timeout.C:
+			return batch, false, nil
+		case <-ctx.Done():
+			return batch, true, nil
+		}
+	}
+	return batch, false, nil
+}
+
+func (ams *TransactionalAsyncMessageSink) Status() (*substrate.Status, error) {
+	return status(ams.client, ams.Topic)
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSink
+// interface.
+func (ams *TransactionalAsyncMessageSink) Close() error {
+	return ams.client.Close()
+}
+
 // AsyncMessageSource represents a kafka message source and implements the
 // substrate.AsyncMessageSource interface.
 type AsyncMessageSourceConfig struct {
-	ConsumerGroup            string
-	Topic                    string
+	ConsumerGroup string
+
+	// Topic is the single topic to consume from. Deprecated: use Topics.
+	Topic string
+
+	// Topics is the set of topics to consume from. If both Topic and
+	// Topics are set, they're combined.
+	Topics []string
+
+	// TopicRegex, if set, is matched against the client's known topics
+	// each time the source joins a new consumer group generation, and any
+	// matching topic is added to the consumed set alongside Topic/Topics.
+	// A topic that starts matching during a generation is not consumed
+	// until the next generation begins.
+	TopicRegex string
+
 	Brokers                  []string
 	Offset                   int64
 	MetadataRefreshFrequency time.Duration
 	OffsetsRetention         time.Duration
 	Version                  *sarama.KafkaVersion
+
+	// TLS, if set, enables TLS and is used to configure the connection to
+	// the broker.
+	TLS *tls.Config
+
+	// SASL, if set, enables SASL authentication with the broker.
+	SASL *SASLConfig
 }
 
-func (ams *AsyncMessageSourceConfig) buildSaramaConsumerConfig() *cluster.Config {
+func (ams *AsyncMessageSourceConfig) buildSaramaConsumerConfig() *sarama.Config {
 	offset := OffsetNewest
 	if ams.Offset != 0 {
 		offset = ams.Offset
@@ -163,76 +554,415 @@ func (ams *AsyncMessageSourceConfig) buildSaramaConsumerConfig() *cluster.Config
 		mrf = ams.MetadataRefreshFrequency
 	}
 
-	config := cluster.NewConfig()
+	config := sarama.NewConfig()
 	config.Consumer.Return.Errors = true
 	config.Consumer.Offsets.Initial = offset
 	config.Metadata.RefreshFrequency = mrf
 	config.Consumer.Offsets.Retention = ams.OffsetsRetention
 
+	// Consumer groups require at least the version that introduced them.
+	config.Version = sarama.V0_10_2_0
 	if ams.Version != nil {
 		config.Version = *ams.Version
 	}
+
+	if ams.TLS != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = ams.TLS
+	}
+
+	if ams.SASL != nil {
+		ams.SASL.apply(config)
+	}
+
 	return config
 }
 
 func NewAsyncMessageSource(c AsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
 	config := c.buildSaramaConsumerConfig()
 
-	client, err := cluster.NewClient(c.Brokers, config)
+	client, err := sarama.NewClient(c.Brokers, config)
 	if err != nil {
 		return nil, err
 	}
 
+	consumerGroup, err := sarama.NewConsumerGroupFromClient(c.ConsumerGroup, client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	var topicRegex *regexp.Regexp
+	if c.TopicRegex != "" {
+		topicRegex, err = regexp.Compile(c.TopicRegex)
+		if err != nil {
+			_ = consumerGroup.Close()
+			_ = client.Close()
+			return nil, err
+		}
+	}
+
 	return &AsyncMessageSource{
 		client:        client,
-		consumerGroup: c.ConsumerGroup,
+		consumerGroup: consumerGroup,
+		topics:        c.Topics,
 		topic:         c.Topic,
+		topicRegex:    topicRegex,
 	}, nil
 }
 
 type AsyncMessageSource struct {
-	client        *cluster.Client
-	consumerGroup string
+	client        sarama.Client
+	consumerGroup sarama.ConsumerGroup
+	topics        []string
 	topic         string
+	topicRegex    *regexp.Regexp
+}
+
+// resolveTopics returns the set of topics to subscribe to: the explicitly
+// configured topics plus, if TopicRegex was set, any topic known to the
+// client that matches it.
+func (ams *AsyncMessageSource) resolveTopics() ([]string, error) {
+	topics := append([]string{}, ams.topics...)
+	if ams.topic != "" {
+		topics = append(topics, ams.topic)
+	}
+
+	if ams.topicRegex != nil {
+		known, err := ams.client.Topics()
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range known {
+			if ams.topicRegex.MatchString(t) {
+				topics = append(topics, t)
+			}
+		}
+	}
+
+	return topics, nil
 }
 
 type consumerMessage struct {
-	cm *sarama.ConsumerMessage
+	cm      *sarama.ConsumerMessage
+	session sarama.ConsumerGroupSession
 }
 
 func (cm *consumerMessage) Data() []byte {
 	return cm.cm.Value
 }
 
+// Key returns the message's Kafka key, if any.
+func (cm *consumerMessage) Key() []byte {
+	return cm.cm.Key
+}
+
+// Headers returns the message's Kafka headers, if any.
+func (cm *consumerMessage) Headers() []sarama.RecordHeader {
+	headers := make([]sarama.RecordHeader, 0, len(cm.cm.Headers))
+	for _, h := range cm.cm.Headers {
+		headers = append(headers, *h)
+	}
+	return headers
+}
+
+// Timestamp returns the broker timestamp recorded against the message.
+func (cm *consumerMessage) Timestamp() time.Time {
+	return cm.cm.Timestamp
+}
+
+// Topic returns the topic the message was consumed from.
+func (cm *consumerMessage) Topic() string {
+	return cm.cm.Topic
+}
+
+// Partition returns the partition the message was consumed from.
+func (cm *consumerMessage) Partition() int32 {
+	return cm.cm.Partition
+}
+
+// Offset returns the message's offset within its partition.
+func (cm *consumerMessage) Offset() int64 {
+	return cm.cm.Offset
+}
+
+// consumerGroupHandler implements sarama.ConsumerGroupHandler, forwarding
+// every claimed message onto a channel read by ConsumeMessages.
+type consumerGroupHandler struct {
+	out chan<- *consumerMessage
+}
+
+// Setup is called at the beginning of a new session, before ConsumeClaim.
+func (h *consumerGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is called at the end of a session, once all ConsumeClaim
+// goroutines have exited.
+func (h *consumerGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim forwards every message on the claimed partition to the
+// handler's output channel, until the claim's messages channel is closed
+// (generation ended) or the session is done (rebalance/shutdown).
+func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		select {
+		case h.out <- &consumerMessage{cm: msg, session: session}:
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
 // ConsumeMessages implements the ConsumeMessages method of the substrate.AsyncMessageSource interface.
 func (ams *AsyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
 
-	c, err := cluster.NewConsumerFromClient(ams.client, ams.consumerGroup, []string{ams.topic})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	innerMessages := make(chan *consumerMessage)
+	handler := &consumerGroupHandler{out: innerMessages}
+
+	consumeErrs := make(chan error, 1)
+	go func() {
+		for ctx.Err() == nil {
+			// Topics are re-resolved on every generation so that topics
+			// newly matching TopicRegex are picked up without having to
+			// restart the source.
+			topics, err := ams.resolveTopics()
+			if err != nil {
+				consumeErrs <- err
+				return
+			}
+
+			// Consume returns at the end of each generation (e.g. on a
+			// rebalance); looping re-joins the group for the next one.
+			if err := ams.consumerGroup.Consume(ctx, topics, handler); err != nil {
+				consumeErrs <- err
+				return
+			}
+		}
+	}()
+
+	var forAcking []*consumerMessage
+
+	for {
+		select {
+		case msg := <-innerMessages:
+			select {
+			case <-ctx.Done():
+				return nil
+			case messages <- msg:
+			}
+
+			forAcking = append(forAcking, msg)
+		case ack := <-acks:
+			switch {
+			case len(forAcking) == 0:
+				return substrate.InvalidAckError{
+					Acked:    ack,
+					Expected: nil,
+				}
+			case ack != forAcking[0]:
+				return substrate.InvalidAckError{
+					Acked:    ack,
+					Expected: forAcking[0],
+				}
+			default:
+				// If the message's generation has already ended (its
+				// partition was revoked in a rebalance), there's no
+				// session left to mark the offset on.
+				if forAcking[0].session.Context().Err() == nil {
+					forAcking[0].session.MarkMessage(forAcking[0].cm, "")
+				}
+				forAcking = forAcking[1:]
+			}
+
+		case err := <-ams.consumerGroup.Errors():
+			return err
+		case err := <-consumeErrs:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (ams *AsyncMessageSource) Status() (*substrate.Status, error) {
+	topics, err := ams.resolveTopics()
+	if err != nil || len(topics) == 0 {
+		return status(ams.client, ams.topic)
+	}
+	return status(ams.client, topics[0])
+}
+
+// Close implements the Close method of the substrate.AsyncMessageSource
+// interface.
+func (ams *AsyncMessageSource) Close() error {
+	if err := ams.consumerGroup.Close(); err != nil {
+		_ = ams.client.Close()
+		return err
+	}
+	return ams.client.Close()
+}
+
+// PartitionOffset identifies a single partition to consume, along with the
+// offset to start consuming it from.
+type PartitionOffset struct {
+	Partition int32
+
+	// Offset is the concrete offset to start consuming from, or one of
+	// the OffsetOldest/OffsetNewest sentinels. Ignored if Timestamp is
+	// set.
+	Offset int64
+
+	// Timestamp, if set, is resolved to a concrete offset via
+	// sarama.Client.GetOffset and takes precedence over Offset.
+	Timestamp *time.Time
+}
+
+// PartitionedAsyncMessageSourceConfig configures a PartitionedAsyncMessageSource.
+type PartitionedAsyncMessageSourceConfig struct {
+	Brokers     []string
+	Topic       string
+	Assignments []PartitionOffset
+	Version     *sarama.KafkaVersion
+
+	// TLS, if set, enables TLS and is used to configure the connection to
+	// the broker.
+	TLS *tls.Config
+
+	// SASL, if set, enables SASL authentication with the broker.
+	SASL *SASLConfig
+}
+
+func (c *PartitionedAsyncMessageSourceConfig) buildSaramaConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+
+	if c.Version != nil {
+		config.Version = *c.Version
+	}
+
+	if c.TLS != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = c.TLS
+	}
+
+	if c.SASL != nil {
+		c.SASL.apply(config)
+	}
+
+	return config
+}
+
+// NewPartitionedAsyncMessageSource returns a substrate.AsyncMessageSource
+// that consumes a fixed set of (topic, partition, offset) assignments
+// directly, bypassing consumer groups entirely. This is intended for
+// replay tooling and stateful stream processors that manage their own
+// partition assignment and offset tracking.
+func NewPartitionedAsyncMessageSource(c PartitionedAsyncMessageSourceConfig) (substrate.AsyncMessageSource, error) {
+	config := c.buildSaramaConfig()
+
+	client, err := sarama.NewClient(c.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PartitionedAsyncMessageSource{
+		client:      client,
+		topic:       c.Topic,
+		assignments: c.Assignments,
+	}, nil
+}
+
+// PartitionedAsyncMessageSource represents a kafka message source that
+// consumes an explicit set of partitions at explicit offsets, and
+// implements the substrate.AsyncMessageSource interface.
+type PartitionedAsyncMessageSource struct {
+	client      sarama.Client
+	topic       string
+	assignments []PartitionOffset
+}
+
+// resolveOffset returns the concrete offset to start consuming a from, by
+// resolving a.Timestamp via the broker if set, or else using a.Offset
+// as-is (a concrete offset or an OffsetOldest/OffsetNewest sentinel).
+func (ams *PartitionedAsyncMessageSource) resolveOffset(a PartitionOffset) (int64, error) {
+	if a.Timestamp == nil {
+		return a.Offset, nil
+	}
+	return ams.client.GetOffset(ams.topic, a.Partition, a.Timestamp.UnixNano()/int64(time.Millisecond))
+}
+
+// ConsumeMessages implements the ConsumeMessages method of the substrate.AsyncMessageSource interface.
+func (ams *PartitionedAsyncMessageSource) ConsumeMessages(ctx context.Context, messages chan<- substrate.Message, acks <-chan substrate.Message) error {
+
+	consumer, err := sarama.NewConsumerFromClient(ams.client)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = consumer.Close()
+	}()
 
+	innerMessages := make(chan *consumerMessage)
+	consumeErrs := make(chan error, len(ams.assignments))
+
+	var partitionConsumers []sarama.PartitionConsumer
 	defer func() {
-		_ = c.Close()
+		for _, pc := range partitionConsumers {
+			_ = pc.Close()
+		}
 	}()
 
-	var forAcking []*consumerMessage
+	for _, a := range ams.assignments {
+		offset, err := ams.resolveOffset(a)
+		if err != nil {
+			return err
+		}
 
-	for {
-		select {
-		case msg := <-c.Messages():
+		pc, err := consumer.ConsumePartition(ams.topic, a.Partition, offset)
+		if err != nil {
+			return err
+		}
+		partitionConsumers = append(partitionConsumers, pc)
+
+		go func(pc sarama.PartitionConsumer) {
+			for msg := range pc.Messages() {
+				select {
+				case innerMessages <- &consumerMessage{cm: msg}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(pc)
 
-			message := &consumerMessage{
-				cm: msg,
+		go func(pc sarama.PartitionConsumer) {
+			for err := range pc.Errors() {
+				select {
+				case consumeErrs <- err:
+				case <-ctx.Done():
+				}
 			}
+		}(pc)
+	}
+
+	var forAcking []*consumerMessage
 
+	for {
+		select {
+		case msg := <-innerMessages:
 			select {
 			case <-ctx.Done():
-				return c.Close()
-			case messages <- message:
+				return nil
+			case messages <- msg:
 			}
 
-			forAcking = append(forAcking, message)
+			forAcking = append(forAcking, msg)
 		case ack := <-acks:
 			switch {
 			case len(forAcking) == 0:
@@ -246,25 +976,23 @@ func (ams *AsyncMessageSource) ConsumeMessages(ctx context.Context, messages cha
 					Expected: forAcking[0],
 				}
 			default:
-				c.MarkOffset(forAcking[0].cm, "")
 				forAcking = forAcking[1:]
 			}
 
-		case err := <-c.Errors():
+		case err := <-consumeErrs:
 			return err
 		case <-ctx.Done():
-			return c.Close()
+			return nil
 		}
 	}
 }
 
-func (ams *AsyncMessageSource) Status() (*substrate.Status, error) {
+func (ams *PartitionedAsyncMessageSource) Status() (*substrate.Status, error) {
 	return status(ams.client, ams.topic)
 }
 
 // Close implements the Close method of the substrate.AsyncMessageSource
 // interface.
-func (ams *AsyncMessageSource) Close() error {
+func (ams *PartitionedAsyncMessageSource) Close() error {
 	return ams.client.Close()
-
-}
\ No newline at end of file
+}
@@ -0,0 +1,275 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uw-labs/substrate"
+)
+
+// testMessage is a minimal substrate.Message used to round-trip a payload
+// through a sink and source in the integration test below.
+type testMessage struct {
+	data []byte
+}
+
+func (m *testMessage) Data() []byte { return m.data }
+
+// TestTLSSASLIntegration publishes and consumes a message through a broker
+// that requires both TLS and SASL, exercising the handshake and
+// authentication paths that the unit tests in kafka_test.go can't reach
+// without a real connection. It needs docker on PATH and is skipped
+// otherwise.
+func TestTLSSASLIntegration(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not available")
+	}
+
+	broker, err := runTLSSASLServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.kill()
+
+	topic := "tls-sasl-integration"
+	tlsConfig := broker.clientTLSConfig()
+
+	sink, err := NewAsyncMessageSink(AsyncMessageSinkConfig{
+		Brokers: broker.brokers(),
+		Topic:   topic,
+		TLS:     tlsConfig,
+		SASL: &SASLConfig{
+			Username:  broker.username,
+			Password:  broker.password,
+			Mechanism: SASLMechanismPlain,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAsyncMessageSink() error = %v", err)
+	}
+	defer sink.Close()
+
+	source, err := NewAsyncMessageSource(AsyncMessageSourceConfig{
+		Brokers:       broker.brokers(),
+		Topic:         topic,
+		ConsumerGroup: topic,
+		Offset:        OffsetOldest,
+		TLS:           tlsConfig,
+		SASL: &SASLConfig{
+			Username:  broker.username,
+			Password:  broker.password,
+			Mechanism: SASLMechanismPlain,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAsyncMessageSource() error = %v", err)
+	}
+	defer source.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	want := "hello over tls+sasl"
+	sinkSync := substrate.NewSynchronousMessageSink(sink)
+	if err := sinkSync.PublishMessage(ctx, &testMessage{data: []byte(want)}); err != nil {
+		t.Fatalf("PublishMessage() error = %v", err)
+	}
+
+	got := make(chan string, 1)
+	sourceSync := substrate.NewSynchronousMessageSource(source)
+	go func() {
+		_ = sourceSync.ConsumeMessages(ctx, func(_ context.Context, msg substrate.Message) error {
+			got <- string(msg.Data())
+			cancel()
+			return nil
+		})
+	}()
+
+	select {
+	case payload := <-got:
+		if payload != want {
+			t.Errorf("consumed payload = %q, want %q", payload, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for message over TLS+SASL")
+	}
+}
+
+// tlsSASLServer is a docker-hosted broker with a SASL_SSL listener.
+type tlsSASLServer struct {
+	containerName string
+	port          int
+	caCert        []byte
+	username      string
+	password      string
+}
+
+func (s *tlsSASLServer) brokers() []string {
+	return []string{fmt.Sprintf("127.0.0.1:%d", s.port)}
+}
+
+func (s *tlsSASLServer) clientTLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.caCert)
+	return &tls.Config{RootCAs: pool}
+}
+
+func (s *tlsSASLServer) kill() {
+	_ = exec.Command("docker", "rm", "-f", s.containerName).Run()
+}
+
+// runTLSSASLServer starts a bitnami/kafka broker configured with a
+// SASL_SSL listener (PLAIN mechanism, PEM-encoded keystore passed straight
+// through via environment variables so no keytool/openssl step is needed)
+// and waits for it to accept connections.
+func runTLSSASLServer() (*tlsSASLServer, error) {
+	cert, key, ca, err := selfSignedCert("localhost", "127.0.0.1")
+	if err != nil {
+		return nil, err
+	}
+
+	containerName := fmt.Sprintf("substrate-tls-sasl-%d-%d", os.Getpid(), time.Now().UnixNano())
+	username, password := "client", "client-secret"
+
+	cmd := exec.Command(
+		"docker",
+		"run",
+		"-d",
+		"--rm",
+		"--name", containerName,
+		"-p", "9095:9095",
+		"--env", "KAFKA_CFG_LISTENERS=SASL_SSL://:9095,CONTROLLER://:9093",
+		"--env", "KAFKA_CFG_ADVERTISED_LISTENERS=SASL_SSL://127.0.0.1:9095",
+		"--env", "KAFKA_CFG_LISTENER_SECURITY_PROTOCOL_MAP=SASL_SSL:SASL_SSL,CONTROLLER:PLAINTEXT",
+		"--env", "KAFKA_CFG_SASL_ENABLED_MECHANISMS=PLAIN",
+		"--env", "KAFKA_CFG_SASL_MECHANISM_INTER_BROKER_PROTOCOL=PLAIN",
+		"--env", fmt.Sprintf("KAFKA_CLIENT_USERS=%s", username),
+		"--env", fmt.Sprintf("KAFKA_CLIENT_PASSWORDS=%s", password),
+		"--env", "KAFKA_CFG_SSL_KEYSTORE_TYPE=PEM",
+		"--env", "KAFKA_TLS_TYPE=PEM",
+		"--env", fmt.Sprintf("KAFKA_CERTIFICATE_PASSWORD=%s", ""),
+		"--env", fmt.Sprintf("KAFKA_TLS_CERT=%s", string(cert)),
+		"--env", fmt.Sprintf("KAFKA_TLS_KEY=%s", string(key)),
+		"--env", fmt.Sprintf("KAFKA_TLS_CA_CERT=%s", string(ca)),
+		"bitnami/kafka:latest",
+	)
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	s := &tlsSASLServer{
+		containerName: containerName,
+		port:          9095,
+		caCert:        ca,
+		username:      username,
+		password:      password,
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		portCmd := exec.Command("docker", "port", containerName, "9095/tcp")
+		out, err := portCmd.CombinedOutput()
+		if err == nil {
+			outS := strings.TrimSpace(string(out))
+			if i := strings.Index(outS, "\n"); i > -1 {
+				outS = outS[:i]
+			}
+			ps := strings.Split(outS, ":")
+			if len(ps) == 2 {
+				if p, err := strconv.Atoi(ps[1]); err == nil {
+					s.port = p
+					break
+				}
+			}
+		} else if !bytes.Contains(out, []byte("No such container:")) {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			s.kill()
+			return nil, fmt.Errorf("timed out waiting for %s to start", containerName)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The published port is reported as soon as the container starts, so
+	// also wait until the broker completes a TLS handshake on it.
+	for {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", s.brokers()[0], s.clientTLSConfig())
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			s.kill()
+			return nil, fmt.Errorf("timed out waiting for %s to accept connections: %v", containerName, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return s, nil
+}
+
+// selfSignedCert generates a self-signed certificate valid for the given
+// hosts, returning the PEM-encoded cert, private key, and (since it's
+// self-signed) the same cert again to use as the CA that clients trust.
+func selfSignedCert(hosts ...string) (cert, key, ca []byte, rerr error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, certPEM, nil
+}
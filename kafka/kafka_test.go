@@ -0,0 +1,615 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/uw-labs/substrate"
+)
+
+func TestBuildSaramaProducerConfigDefaults(t *testing.T) {
+	config := AsyncMessageSinkConfig{}
+	conf := config.buildSaramaProducerConfig()
+
+	if conf.Producer.RequiredAcks != sarama.WaitForAll {
+		t.Errorf("RequiredAcks = %v, want %v", conf.Producer.RequiredAcks, sarama.WaitForAll)
+	}
+	if conf.Producer.Retry.Max != 3 {
+		t.Errorf("Retry.Max = %d, want 3", conf.Producer.Retry.Max)
+	}
+	if conf.Producer.Compression != sarama.CompressionNone {
+		t.Errorf("Compression = %v, want %v", conf.Producer.Compression, sarama.CompressionNone)
+	}
+	if conf.Producer.Idempotent {
+		t.Error("Idempotent = true, want false")
+	}
+	if conf.Net.TLS.Enable {
+		t.Error("TLS.Enable = true, want false")
+	}
+	if conf.Net.SASL.Enable {
+		t.Error("SASL.Enable = true, want false")
+	}
+}
+
+func TestBuildSaramaProducerConfigOptions(t *testing.T) {
+	none := RequiredAcksNone
+	config := AsyncMessageSinkConfig{
+		Compression:    CompressionSnappy,
+		RequiredAcks:   &none,
+		MaxRetries:     7,
+		FlushFrequency: 2 * time.Second,
+		FlushMessages:  50,
+		FlushBytes:     1024,
+	}
+	conf := config.buildSaramaProducerConfig()
+
+	if conf.Producer.Compression != sarama.CompressionSnappy {
+		t.Errorf("Compression = %v, want %v", conf.Producer.Compression, sarama.CompressionSnappy)
+	}
+	if conf.Producer.RequiredAcks != sarama.NoResponse {
+		t.Errorf("RequiredAcks = %v, want %v (RequiredAcksNone must not be mistaken for unset)", conf.Producer.RequiredAcks, sarama.NoResponse)
+	}
+	if conf.Producer.Retry.Max != 7 {
+		t.Errorf("Retry.Max = %d, want 7", conf.Producer.Retry.Max)
+	}
+	if conf.Producer.Flush.Frequency != 2*time.Second {
+		t.Errorf("Flush.Frequency = %v, want 2s", conf.Producer.Flush.Frequency)
+	}
+	if conf.Producer.Flush.Messages != 50 {
+		t.Errorf("Flush.Messages = %d, want 50", conf.Producer.Flush.Messages)
+	}
+	if conf.Producer.Flush.Bytes != 1024 {
+		t.Errorf("Flush.Bytes = %d, want 1024", conf.Producer.Flush.Bytes)
+	}
+}
+
+func TestBuildSaramaProducerConfigIdempotent(t *testing.T) {
+	config := AsyncMessageSinkConfig{Idempotent: true}
+	conf := config.buildSaramaProducerConfig()
+
+	if !conf.Producer.Idempotent {
+		t.Error("Idempotent = false, want true")
+	}
+	if conf.Net.MaxOpenRequests != 1 {
+		t.Errorf("MaxOpenRequests = %d, want 1", conf.Net.MaxOpenRequests)
+	}
+	if conf.Producer.RequiredAcks != sarama.WaitForAll {
+		t.Errorf("RequiredAcks = %v, want %v", conf.Producer.RequiredAcks, sarama.WaitForAll)
+	}
+}
+
+func TestBuildSaramaProducerConfigTLSAndSASL(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	config := AsyncMessageSinkConfig{
+		TLS: tlsConfig,
+		SASL: &SASLConfig{
+			Username:  "user",
+			Password:  "pass",
+			Mechanism: SASLMechanismSCRAMSHA256,
+		},
+	}
+	conf := config.buildSaramaProducerConfig()
+
+	if !conf.Net.TLS.Enable || conf.Net.TLS.Config != tlsConfig {
+		t.Error("TLS not wired onto sarama config")
+	}
+	if !conf.Net.SASL.Enable || conf.Net.SASL.User != "user" || conf.Net.SASL.Password != "pass" {
+		t.Error("SASL credentials not wired onto sarama config")
+	}
+	if conf.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA256 {
+		t.Errorf("SASL.Mechanism = %v, want %v", conf.Net.SASL.Mechanism, sarama.SASLTypeSCRAMSHA256)
+	}
+}
+
+func TestBuildSaramaConsumerConfig(t *testing.T) {
+	config := AsyncMessageSourceConfig{
+		Offset:                   OffsetOldest,
+		MetadataRefreshFrequency: 5 * time.Minute,
+	}
+	conf := config.buildSaramaConsumerConfig()
+
+	if conf.Consumer.Offsets.Initial != OffsetOldest {
+		t.Errorf("Offsets.Initial = %d, want %d", conf.Consumer.Offsets.Initial, OffsetOldest)
+	}
+	if conf.Metadata.RefreshFrequency != 5*time.Minute {
+		t.Errorf("Metadata.RefreshFrequency = %v, want 5m", conf.Metadata.RefreshFrequency)
+	}
+	if conf.Version != sarama.V0_10_2_0 {
+		t.Errorf("Version = %v, want %v (consumer groups require it by default)", conf.Version, sarama.V0_10_2_0)
+	}
+}
+
+// fakeClient is a sarama.Client that panics on any method not explicitly
+// overridden, so tests fail loudly if the code under test reaches for
+// something unexpected.
+type fakeClient struct {
+	sarama.Client
+	topics    []string
+	topicsErr error
+}
+
+func (f *fakeClient) Topics() ([]string, error) {
+	return f.topics, f.topicsErr
+}
+
+func TestResolveTopicsCombinesExplicitAndRegex(t *testing.T) {
+	ams := &AsyncMessageSource{
+		client: &fakeClient{topics: []string{"orders.eu", "orders.us", "payments"}},
+		topics: []string{"audit"},
+		topic:  "legacy",
+	}
+	var err error
+	ams.topicRegex, err = regexp.Compile(`^orders\.`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ams.resolveTopics()
+	if err != nil {
+		t.Fatalf("resolveTopics() error = %v", err)
+	}
+
+	want := map[string]bool{"audit": true, "legacy": true, "orders.eu": true, "orders.us": true}
+	if len(got) != len(want) {
+		t.Fatalf("resolveTopics() = %v, want %v", got, want)
+	}
+	for _, topic := range got {
+		if !want[topic] {
+			t.Errorf("resolveTopics() returned unexpected topic %q", topic)
+		}
+	}
+}
+
+func TestResolveTopicsWithoutRegexDoesNotTouchClient(t *testing.T) {
+	ams := &AsyncMessageSource{
+		client: nil, // would panic if resolveTopics called Topics()
+		topic:  "legacy",
+	}
+
+	got, err := ams.resolveTopics()
+	if err != nil {
+		t.Fatalf("resolveTopics() error = %v", err)
+	}
+	if len(got) != 1 || got[0] != "legacy" {
+		t.Errorf("resolveTopics() = %v, want [legacy]", got)
+	}
+}
+
+func TestResolveOffsetUsesConcreteOffset(t *testing.T) {
+	ams := &PartitionedAsyncMessageSource{client: &fakeClient{}, topic: "orders"}
+
+	offset, err := ams.resolveOffset(PartitionOffset{Partition: 3, Offset: 42})
+	if err != nil {
+		t.Fatalf("resolveOffset() error = %v", err)
+	}
+	if offset != 42 {
+		t.Errorf("resolveOffset() = %d, want 42", offset)
+	}
+}
+
+type fakeOffsetClient struct {
+	sarama.Client
+	gotTopic     string
+	gotPartition int32
+	gotTimestamp int64
+	offset       int64
+}
+
+func (f *fakeOffsetClient) GetOffset(topic string, partition int32, timestamp int64) (int64, error) {
+	f.gotTopic = topic
+	f.gotPartition = partition
+	f.gotTimestamp = timestamp
+	return f.offset, nil
+}
+
+func TestResolveOffsetUsesTimestampWhenSet(t *testing.T) {
+	client := &fakeOffsetClient{offset: 99}
+	ams := &PartitionedAsyncMessageSource{client: client, topic: "orders"}
+
+	ts := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	offset, err := ams.resolveOffset(PartitionOffset{Partition: 2, Offset: OffsetOldest, Timestamp: &ts})
+	if err != nil {
+		t.Fatalf("resolveOffset() error = %v", err)
+	}
+	if offset != 99 {
+		t.Errorf("resolveOffset() = %d, want 99 (from GetOffset)", offset)
+	}
+	if client.gotTopic != "orders" || client.gotPartition != 2 {
+		t.Errorf("GetOffset called with (%q, %d), want (orders, 2)", client.gotTopic, client.gotPartition)
+	}
+	if client.gotTimestamp != ts.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("GetOffset timestamp = %d, want %d", client.gotTimestamp, ts.UnixNano()/int64(time.Millisecond))
+	}
+}
+
+// fakeConsumerGroupSession is a minimal sarama.ConsumerGroupSession that
+// just records MarkMessage calls.
+type fakeConsumerGroupSession struct {
+	ctx    context.Context
+	marked []*sarama.ConsumerMessage
+}
+
+func (f *fakeConsumerGroupSession) Claims() map[string][]int32               { return nil }
+func (f *fakeConsumerGroupSession) MemberID() string                         { return "" }
+func (f *fakeConsumerGroupSession) GenerationID() int32                      { return 0 }
+func (f *fakeConsumerGroupSession) MarkOffset(string, int32, int64, string)  {}
+func (f *fakeConsumerGroupSession) Commit()                                  {}
+func (f *fakeConsumerGroupSession) ResetOffset(string, int32, int64, string) {}
+func (f *fakeConsumerGroupSession) Context() context.Context                 { return f.ctx }
+func (f *fakeConsumerGroupSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	f.marked = append(f.marked, msg)
+}
+
+type fakeConsumerGroupClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func (f *fakeConsumerGroupClaim) Topic() string                            { return "orders" }
+func (f *fakeConsumerGroupClaim) Partition() int32                         { return 0 }
+func (f *fakeConsumerGroupClaim) InitialOffset() int64                     { return 0 }
+func (f *fakeConsumerGroupClaim) HighWaterMarkOffset() int64               { return 0 }
+func (f *fakeConsumerGroupClaim) Messages() <-chan *sarama.ConsumerMessage { return f.messages }
+
+// fakeConsumerGroup drives the handler through a single claim on its first
+// Consume call, then blocks until ctx is cancelled on every subsequent
+// call, mimicking an idle consumer group between generations.
+type fakeConsumerGroup struct {
+	session   *fakeConsumerGroupSession
+	claim     *fakeConsumerGroupClaim
+	triggered chan struct{}
+}
+
+func newFakeConsumerGroup(session *fakeConsumerGroupSession, claim *fakeConsumerGroupClaim) *fakeConsumerGroup {
+	return &fakeConsumerGroup{session: session, claim: claim, triggered: make(chan struct{})}
+}
+
+func (f *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	select {
+	case <-f.triggered:
+		<-ctx.Done()
+		return ctx.Err()
+	default:
+		close(f.triggered)
+	}
+
+	if err := handler.Setup(f.session); err != nil {
+		return err
+	}
+	err := handler.ConsumeClaim(f.session, f.claim)
+	_ = handler.Cleanup(f.session)
+	return err
+}
+
+func (f *fakeConsumerGroup) Errors() <-chan error      { return nil }
+func (f *fakeConsumerGroup) Close() error              { return nil }
+func (f *fakeConsumerGroup) Pause(map[string][]int32)  {}
+func (f *fakeConsumerGroup) Resume(map[string][]int32) {}
+func (f *fakeConsumerGroup) PauseAll()                 {}
+func (f *fakeConsumerGroup) ResumeAll()                {}
+
+func TestConsumeMessagesMarksOffsetsInOrder(t *testing.T) {
+	session := &fakeConsumerGroupSession{ctx: context.Background()}
+	claim := &fakeConsumerGroupClaim{messages: make(chan *sarama.ConsumerMessage)}
+	cms := []*sarama.ConsumerMessage{
+		{Topic: "orders", Offset: 1},
+		{Topic: "orders", Offset: 2},
+	}
+
+	ams := &AsyncMessageSource{
+		consumerGroup: newFakeConsumerGroup(session, claim),
+		topic:         "orders",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+
+	done := make(chan error, 1)
+	go func() { done <- ams.ConsumeMessages(ctx, messages, acks) }()
+
+	// Feed and ack one message at a time: the source may hold several
+	// unacked messages in flight, but this keeps the test's own
+	// synchronization simple and deterministic.
+	for _, want := range cms {
+		select {
+		case claim.messages <- want:
+		case <-time.After(time.Second):
+			t.Fatal("timed out feeding claim message")
+		}
+
+		select {
+		case msg := <-messages:
+			cm := msg.(*consumerMessage)
+			if cm.cm != want {
+				t.Errorf("consumed message = %+v, want %+v", cm.cm, want)
+			}
+			acks <- msg
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+
+	close(claim.messages)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ConsumeMessages to return")
+	}
+
+	if len(session.marked) != 2 || session.marked[0] != cms[0] || session.marked[1] != cms[1] {
+		t.Errorf("marked messages = %+v, want %+v", session.marked, cms)
+	}
+}
+
+func TestConsumeMessagesRejectsOutOfOrderAck(t *testing.T) {
+	session := &fakeConsumerGroupSession{ctx: context.Background()}
+	claim := &fakeConsumerGroupClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+	cm1 := &sarama.ConsumerMessage{Topic: "orders", Offset: 1}
+	claim.messages <- cm1
+
+	ams := &AsyncMessageSource{
+		consumerGroup: newFakeConsumerGroup(session, claim),
+		topic:         "orders",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+
+	done := make(chan error, 1)
+	go func() { done <- ams.ConsumeMessages(ctx, messages, acks) }()
+
+	select {
+	case <-messages:
+		// Ack something we were never sent, instead of the message above.
+		acks <- &consumerMessage{cm: &sarama.ConsumerMessage{Topic: "orders", Offset: 99}}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	select {
+	case err := <-done:
+		if _, ok := err.(substrate.InvalidAckError); !ok {
+			t.Fatalf("ConsumeMessages() error = %v, want substrate.InvalidAckError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ConsumeMessages to return")
+	}
+}
+
+// fakeAsyncProducer is a minimal sarama.AsyncProducer that accepts whatever
+// is written to Input without ever producing a Success, and records
+// transaction calls so tests can assert on commit/abort behaviour.
+type fakeAsyncProducer struct {
+	input     chan *sarama.ProducerMessage
+	errs      chan *sarama.ProducerError
+	successes chan *sarama.ProducerMessage
+
+	commitErr error
+
+	mu        sync.Mutex
+	begun     int
+	committed int
+	aborted   int
+}
+
+func newFakeAsyncProducer() *fakeAsyncProducer {
+	p := &fakeAsyncProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		errs:      make(chan *sarama.ProducerError),
+		successes: make(chan *sarama.ProducerMessage),
+	}
+	go func() {
+		for range p.input {
+		}
+	}()
+	return p
+}
+
+func (p *fakeAsyncProducer) AsyncClose()                               {}
+func (p *fakeAsyncProducer) Close() error                              { return nil }
+func (p *fakeAsyncProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *fakeAsyncProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *fakeAsyncProducer) Errors() <-chan *sarama.ProducerError      { return p.errs }
+func (p *fakeAsyncProducer) IsTransactional() bool                     { return true }
+func (p *fakeAsyncProducer) TxnStatus() sarama.ProducerTxnStatusFlag   { return 0 }
+
+func (p *fakeAsyncProducer) BeginTxn() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.begun++
+	return nil
+}
+
+func (p *fakeAsyncProducer) CommitTxn() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.committed++
+	return p.commitErr
+}
+
+func (p *fakeAsyncProducer) AbortTxn() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aborted++
+	return nil
+}
+
+func (p *fakeAsyncProducer) AddOffsetsToTxn(map[string][]*sarama.PartitionOffsetMetadata, string) error {
+	return nil
+}
+
+func (p *fakeAsyncProducer) AddMessageToTxn(*sarama.ConsumerMessage, string, *string) error {
+	return nil
+}
+
+func (p *fakeAsyncProducer) counts() (begun, committed, aborted int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.begun, p.committed, p.aborted
+}
+
+func TestTransactionalDoPublishMessagesCommitsAndDeliversAcks(t *testing.T) {
+	producer := newFakeAsyncProducer()
+	ams := &TransactionalAsyncMessageSink{Topic: "orders", batchSize: 1, batchTimeout: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+
+	done := make(chan error, 1)
+	go func() { done <- ams.doPublishMessages(ctx, producer, acks, messages) }()
+
+	m := &testMessage{data: []byte("m1")}
+	select {
+	case messages <- m:
+	case <-time.After(time.Second):
+		t.Fatal("timed out sending message")
+	}
+
+	select {
+	case got := <-acks:
+		if got != substrate.Message(m) {
+			t.Errorf("acked message = %v, want %v", got, m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ack")
+	}
+
+	close(messages)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("doPublishMessages() error = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for doPublishMessages to return")
+	}
+
+	if _, committed, _ := producer.counts(); committed != 1 {
+		t.Errorf("committed = %d, want 1", committed)
+	}
+}
+
+// TestTransactionalDoPublishMessagesReturnsWhenAcksUnread reproduces an
+// ordinary shutdown race: the caller stops reading acks right as a
+// transaction commits. doPublishMessages must still return promptly instead
+// of blocking forever on the unread ack.
+func TestTransactionalDoPublishMessagesReturnsWhenAcksUnread(t *testing.T) {
+	producer := newFakeAsyncProducer()
+	ams := &TransactionalAsyncMessageSink{Topic: "orders", batchSize: 1, batchTimeout: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan substrate.Message, 1)
+	messages <- &testMessage{data: []byte("m1")}
+	close(messages)
+
+	acks := make(chan substrate.Message) // deliberately never read from
+
+	done := make(chan error, 1)
+	go func() { done <- ams.doPublishMessages(ctx, producer, acks, messages) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("doPublishMessages() error = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("doPublishMessages did not return; ack delivery is blocking the main loop")
+	}
+}
+
+func TestTransactionalDoPublishMessagesAbortsOnProducerError(t *testing.T) {
+	producer := newFakeAsyncProducer()
+	ams := &TransactionalAsyncMessageSink{Topic: "orders", batchSize: 5, batchTimeout: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+
+	done := make(chan error, 1)
+	go func() { done <- ams.doPublishMessages(ctx, producer, acks, messages) }()
+
+	wantErr := &sarama.ProducerError{Err: sarama.ErrOutOfBrokers}
+	select {
+	case producer.errs <- wantErr:
+	case <-time.After(time.Second):
+		t.Fatal("timed out sending producer error")
+	}
+
+	select {
+	case err := <-done:
+		if err != wantErr {
+			t.Errorf("doPublishMessages() error = %v, want %v", err, wantErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for doPublishMessages to return")
+	}
+
+	if _, committed, aborted := producer.counts(); committed != 0 || aborted != 1 {
+		t.Errorf("committed = %d, aborted = %d, want 0, 1", committed, aborted)
+	}
+}
+
+func TestTransactionalDoPublishMessagesCommitsPartialBatchOnCtxCancel(t *testing.T) {
+	producer := newFakeAsyncProducer()
+	ams := &TransactionalAsyncMessageSink{Topic: "orders", batchSize: 5, batchTimeout: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	messages := make(chan substrate.Message)
+	acks := make(chan substrate.Message)
+
+	done := make(chan error, 1)
+	go func() { done <- ams.doPublishMessages(ctx, producer, acks, messages) }()
+
+	m := &testMessage{data: []byte("m1")}
+	select {
+	case messages <- m:
+	case <-time.After(time.Second):
+		t.Fatal("timed out sending message")
+	}
+
+	// Cancel before the batch fills up; the message already produced
+	// should still be committed and acked rather than lost.
+	cancel()
+
+	select {
+	case got := <-acks:
+		if got != substrate.Message(m) {
+			t.Errorf("acked message = %v, want %v", got, m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ack of partial batch")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("doPublishMessages() error = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for doPublishMessages to return")
+	}
+
+	if _, committed, aborted := producer.counts(); committed != 1 || aborted != 0 {
+		t.Errorf("committed = %d, aborted = %d, want 1, 0", committed, aborted)
+	}
+}